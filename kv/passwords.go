@@ -1,10 +1,29 @@
 package kv
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode"
 
+	"go.uber.org/zap"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
 
 	"github.com/influxdata/influxdb/v2"
 )
@@ -29,12 +48,57 @@ var (
 
 	// EShortPassword is used when a password is less than the minimum
 	// acceptable password length.
+	//
+	// Deprecated: use EPasswordTooShort, which reports the configured
+	// PasswordPolicy.MinLength instead of assuming 8.
 	EShortPassword = &influxdb.Error{
 		Code: influxdb.EInvalid,
 		Msg:  "passwords must be at least 8 characters long",
 	}
+
+	// EPasswordTooCommon is returned when a password matches an entry in the
+	// configured PasswordPolicy.BreachChecker's compromised-password list.
+	EPasswordTooCommon = &influxdb.Error{
+		Code: influxdb.EInvalid,
+		Msg:  "password appears in a list of known compromised passwords",
+	}
+
+	// EPasswordContainsUsername is returned when a password contains the
+	// account's own username, which PasswordPolicy.DisallowUsernameSubstring
+	// forbids.
+	EPasswordContainsUsername = &influxdb.Error{
+		Code: influxdb.EInvalid,
+		Msg:  "password must not contain the username",
+	}
 )
 
+// EPasswordTooShort is returned when a password is shorter than
+// PasswordPolicy.MinLength.
+func EPasswordTooShort(minLength int) *influxdb.Error {
+	return &influxdb.Error{
+		Code: influxdb.EInvalid,
+		Msg:  fmt.Sprintf("passwords must be at least %d characters long", minLength),
+	}
+}
+
+// EPasswordTooLong is returned when a password is longer than
+// PasswordPolicy.MaxLength.
+func EPasswordTooLong(maxLength int) *influxdb.Error {
+	return &influxdb.Error{
+		Code: influxdb.EInvalid,
+		Msg:  fmt.Sprintf("passwords must be at most %d characters long", maxLength),
+	}
+}
+
+// EPasswordMissingClass is returned when a password is missing one or more
+// of the character classes required by PasswordPolicy.RequireClasses.
+func EPasswordMissingClass(missing PasswordClass) *influxdb.Error {
+	return &influxdb.Error{
+		Code: influxdb.EInvalid,
+		Msg:  fmt.Sprintf("password must also contain: %s", missing),
+	}
+}
+
 // UnavailablePasswordServiceError is used if we aren't able to add the
 // password to the store, it means the store is not available at the moment
 // (e.g. network).
@@ -66,97 +130,445 @@ func InternalPasswordHashError(err error) *influxdb.Error {
 	}
 }
 
+// EAccountLocked is returned from ComparePassword/CompareAndSetPassword when
+// an account has too many recent failed login attempts. lockedUntil is
+// surfaced so clients know when it's worth retrying.
+func EAccountLocked(lockedUntil time.Time) *influxdb.Error {
+	return &influxdb.Error{
+		Code: influxdb.ETooManyRequests,
+		Msg:  fmt.Sprintf("account temporarily locked due to too many failed login attempts; try again after %s", lockedUntil.UTC().Format(time.RFC3339)),
+		Op:   "kv/comparePassword",
+	}
+}
+
 var (
-	userpasswordBucket = []byte("userspasswordv1")
+	userpasswordBucket         = []byte("userspasswordv1")
+	userpasswordscramBucket    = []byte("userspasswordscramv1")
+	usercertfpBucket           = []byte("usercertfpv1")
+	userpasswordfailuresBucket = []byte("userpasswordfailuresv1")
 )
 
-var _ influxdb.PasswordsService = (*Service)(nil)
+// Default brute-force lockout policy, used when the corresponding Service
+// field is left unset.
+const (
+	DefaultLockoutThreshold    = 5
+	DefaultLockoutWindow       = 15 * time.Minute
+	DefaultLockoutBaseDuration = 1 * time.Minute
+)
 
-// CompareAndSetPassword checks the password and if they match
-// updates to the new password.
-func (s *Service) CompareAndSetPassword(ctx context.Context, userID influxdb.ID, old string, new string) error {
-	newHash, err := s.generatePasswordHash(new)
+// failureRecord tracks consecutive failed login attempts for a single user,
+// stored gob-encoded in userpasswordfailuresBucket.
+type failureRecord struct {
+	FailCount       uint32
+	FirstFailUnix   int64
+	LockedUntilUnix int64
+}
+
+// lockoutThreshold returns the number of consecutive failures allowed within
+// the lockout window before an account is locked.
+func (s *Service) lockoutThreshold() uint32 {
+	if s.LockoutThreshold == 0 {
+		return DefaultLockoutThreshold
+	}
+	return s.LockoutThreshold
+}
+
+// lockoutWindow returns the sliding window over which failures accumulate.
+// A failure older than this resets the counter instead of compounding it.
+func (s *Service) lockoutWindow() time.Duration {
+	if s.LockoutWindow == 0 {
+		return DefaultLockoutWindow
+	}
+	return s.LockoutWindow
+}
+
+// lockoutBaseDuration returns the lock duration applied on the failure that
+// first crosses the threshold; it doubles for every failure past that.
+func (s *Service) lockoutBaseDuration() time.Duration {
+	if s.LockoutBaseDuration == 0 {
+		return DefaultLockoutBaseDuration
+	}
+	return s.LockoutBaseDuration
+}
+
+// getFailureRecordTx reads the failure record for encodedID, returning a
+// zero-value record (no error) if none exists yet.
+func (s *Service) getFailureRecordTx(ctx context.Context, tx Tx, encodedID []byte) (failureRecord, error) {
+	b, err := tx.Bucket(userpasswordfailuresBucket)
 	if err != nil {
-		return err
+		return failureRecord{}, UnavailablePasswordServiceError(err)
 	}
 
-	if err := s.compareUserPassword(ctx, userID, old); err != nil {
+	stored, err := b.Get(encodedID)
+	if err != nil {
+		return failureRecord{}, nil
+	}
+
+	var rec failureRecord
+	if err := gob.NewDecoder(bytes.NewReader(stored)).Decode(&rec); err != nil {
+		return failureRecord{}, nil
+	}
+
+	return rec, nil
+}
+
+func (s *Service) putFailureRecordTx(ctx context.Context, tx Tx, encodedID []byte, rec failureRecord) error {
+	b, err := tx.Bucket(userpasswordfailuresBucket)
+	if err != nil {
+		return UnavailablePasswordServiceError(err)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+		return InternalPasswordHashError(err)
+	}
+
+	if err := b.Put(encodedID, buf.Bytes()); err != nil {
+		return UnavailablePasswordServiceError(err)
+	}
+
+	return nil
+}
+
+func (s *Service) clearFailureRecordTx(ctx context.Context, tx Tx, encodedID []byte) error {
+	b, err := tx.Bucket(userpasswordfailuresBucket)
+	if err != nil {
+		return UnavailablePasswordServiceError(err)
+	}
+
+	if err := b.Delete(encodedID); err != nil {
+		return UnavailablePasswordServiceError(err)
+	}
+
+	return nil
+}
+
+// checkLockoutTx returns EAccountLocked if userID is currently locked out.
+// It must run before any password hashing, since the whole point is to stop
+// an attacker from burning the server's CPU on bcrypt/argon2id/scrypt
+// comparisons as part of a credential-stuffing run.
+func (s *Service) checkLockoutTx(ctx context.Context, tx Tx, encodedID []byte) error {
+	rec, err := s.getFailureRecordTx(ctx, tx, encodedID)
+	if err != nil {
 		return err
 	}
 
-	return s.setPasswordHash(ctx, userID, newHash)
+	if rec.LockedUntilUnix == 0 {
+		return nil
+	}
+
+	lockedUntil := time.Unix(rec.LockedUntilUnix, 0)
+	if time.Now().Before(lockedUntil) {
+		return EAccountLocked(lockedUntil)
+	}
+
+	return nil
 }
 
-// SetPassword overrides the password of a known user.
-func (s *Service) SetPassword(ctx context.Context, userID influxdb.ID, password string) error {
-	hash, err := s.generatePasswordHash(password)
+// recordLoginFailureTx increments userID's failure counter and, once it
+// reaches the configured threshold, locks the account for a duration that
+// doubles with every failure past the threshold.
+func (s *Service) recordLoginFailureTx(ctx context.Context, tx Tx, userID influxdb.ID, encodedID []byte) error {
+	rec, err := s.getFailureRecordTx(ctx, tx, encodedID)
 	if err != nil {
 		return err
 	}
 
-	return s.setPasswordHash(ctx, userID, hash)
+	now := time.Now()
+	if rec.FailCount > 0 && now.Sub(time.Unix(rec.FirstFailUnix, 0)) > s.lockoutWindow() {
+		// The window lapsed without enough failures to lock the account;
+		// start counting fresh rather than compounding stale attempts.
+		rec = failureRecord{}
+	}
+
+	if rec.FailCount == 0 {
+		rec.FirstFailUnix = now.Unix()
+	}
+	rec.FailCount++
+
+	threshold := s.lockoutThreshold()
+	if rec.FailCount >= threshold {
+		lockDuration := nextLockoutDuration(s.lockoutBaseDuration(), rec.FailCount, threshold)
+		rec.LockedUntilUnix = now.Add(lockDuration).Unix()
+
+		s.logger().Info("account locked after repeated failed logins",
+			zap.Stringer("user_id", userID),
+			zap.Uint32("fail_count", rec.FailCount),
+			zap.Time("locked_until", now.Add(lockDuration)),
+		)
+	}
+
+	return s.putFailureRecordTx(ctx, tx, encodedID, rec)
 }
 
-// ComparePassword checks if the password matches the password recorded.
-// Passwords that do not match return errors.
-func (s *Service) ComparePassword(ctx context.Context, userID influxdb.ID, password string) error {
-	return s.compareUserPassword(ctx, userID, password)
+// maxLockoutDuration caps how long a single lockout can last no matter how
+// many consecutive failures accrue past the threshold. Besides bounding the
+// wait an operator might need to clear with UnlockAccount, it keeps the
+// doubling in nextLockoutDuration from ever overflowing time.Duration's
+// int64 range.
+const maxLockoutDuration = 24 * time.Hour
+
+// nextLockoutDuration returns how long to lock an account given failCount
+// consecutive failures against threshold: base, doubled once for every
+// failure past the threshold, saturating at maxLockoutDuration instead of
+// overflowing once enough failures accrue.
+func nextLockoutDuration(base time.Duration, failCount, threshold uint32) time.Duration {
+	d := base
+	for i := uint32(0); i < failCount-threshold && d < maxLockoutDuration; i++ {
+		d *= 2
+	}
+	if d <= 0 || d > maxLockoutDuration {
+		d = maxLockoutDuration
+	}
+	return d
 }
 
-func (s *Service) getPasswordHash(ctx context.Context, userID influxdb.ID) ([]byte, error) {
-	var passwordHash []byte
-	err := s.kv.View(ctx, func(tx Tx) error {
-		var err error
+// UnlockAccount clears userID's failure counter and any active lock,
+// allowing an admin to recover an account early.
+func (s *Service) UnlockAccount(ctx context.Context, userID influxdb.ID) error {
+	return s.kv.Update(ctx, func(tx Tx) error {
 		encodedID, err := userID.Encode()
 		if err != nil {
 			return CorruptUserIDError(userID.String(), err)
 		}
 
-		if _, err := s.findUserByID(ctx, tx, userID); err != nil {
-			return EIncorrectUser
-		}
-
-		b, err := tx.Bucket(userpasswordBucket)
-		if err != nil {
-			return UnavailablePasswordServiceError(err)
+		if err := s.clearFailureRecordTx(ctx, tx, encodedID); err != nil {
+			return err
 		}
 
-		passwordHash, err = b.Get(encodedID)
-		if err != nil {
-			return EIncorrectPassword
-		}
+		s.logger().Info("account unlocked", zap.Stringer("user_id", userID))
 
 		return nil
 	})
+}
 
-	return passwordHash, err
+// logger returns the service's logger, or a no-op logger if none was
+// configured, so lock/unlock events can always be emitted safely.
+func (s *Service) logger() *zap.Logger {
+	if s.log == nil {
+		return zap.NewNop()
+	}
+	return s.log
 }
 
-func (s *Service) compareUserPassword(ctx context.Context, userID influxdb.ID, password string) error {
-	passwordHash, err := s.getPasswordHash(ctx, userID)
-	if err != nil {
-		return err
+// Credentials is the full set of non-token authenticators the kv service
+// holds for a single user: a password hash, any TLS client-certificate
+// fingerprints that should authenticate them, and whether password login has
+// been disabled for the account. It's the single source of truth the kv
+// service consults for HTTP basic auth, SASL/SCRAM, and client-cert auth
+// alike.
+type Credentials struct {
+	PasswordHash     []byte
+	CertFingerprints []string
+	Disabled         bool
+	PasswordSetAt    time.Time
+}
+
+// encodeCredentials gob-encodes a Credentials record for storage in
+// userpasswordBucket.
+func encodeCredentials(c Credentials) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(c); err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	hasher := s.Hash
-	if hasher == nil {
-		hasher = &Bcrypt{}
+// decodeCredentials decodes a userpasswordBucket value. Values written
+// before Credentials existed are a bare password record (see
+// passwordRecord): when gob-decoding fails, raw is treated as that legacy
+// PasswordHash with the rest of the record defaulted, exactly as
+// decodePasswordRecord already does for pre-algorithm-tagging bcrypt hashes.
+func decodeCredentials(raw []byte) (Credentials, error) {
+	var c Credentials
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&c); err != nil {
+		return Credentials{PasswordHash: raw}, nil
 	}
+	return c, nil
+}
 
-	if err := hasher.CompareHashAndPassword(passwordHash, []byte(password)); err != nil {
-		return EIncorrectPassword
+// Default SCRAM-SHA-256 parameters, per RFC 5802's guidance and what most
+// SASL SCRAM implementations ship with.
+const (
+	DefaultSCRAMIterations = 4096
+	DefaultSCRAMSaltLen    = 16
+)
+
+// DefaultAlgorithm is the password hashing algorithm used when Service.Algorithm
+// is left unset.
+const DefaultAlgorithm = "bcrypt"
+
+// cryptRegistry maps a stored record's algorithm tag to the Crypt
+// implementation that produced it. Registering a new algorithm here is
+// enough to make it available for both new hashes (once configured as
+// Service.Algorithm) and for comparing existing ones.
+var cryptRegistry = map[string]Crypt{
+	"bcrypt":   &Bcrypt{},
+	"argon2id": &Argon2id{},
+	"scrypt":   &Scrypt{},
+}
+
+// passwordRecord is the decoded form of a userspasswordv1 value. Records are
+// stored as "algorithm$params$hash" (e.g. "bcrypt$cost=10$..." or
+// "argon2id$m=65536,t=3,p=2$salt$hash"); Hash holds everything after the
+// algorithm tag, params and all, since only that algorithm's Crypt knows how
+// to parse its own params/salt layout. A value with no recognized algorithm
+// prefix is treated as a legacy bare bcrypt hash, since that's all this
+// bucket ever held before pluggable algorithms were added.
+type passwordRecord struct {
+	Algorithm string
+	Hash      []byte
+}
+
+// encodePasswordRecord renders a passwordRecord back into its on-disk form.
+func encodePasswordRecord(r passwordRecord) []byte {
+	return []byte(fmt.Sprintf("%s$%s", r.Algorithm, r.Hash))
+}
+
+// decodePasswordRecord parses a userspasswordv1 value, falling back to
+// treating it as a legacy unprefixed bcrypt hash when it doesn't look like
+// an "algorithm$..." record.
+func decodePasswordRecord(raw []byte) passwordRecord {
+	// Legacy bcrypt hashes look like "$2a$10$...": they start with a "$",
+	// so naively splitting on "$" would mistake the cost for an algorithm
+	// name. Anything starting with "$2" predates this scheme.
+	if strings.HasPrefix(string(raw), "$2") {
+		return passwordRecord{Algorithm: "bcrypt", Hash: raw}
 	}
 
-	return nil
+	parts := strings.SplitN(string(raw), "$", 2)
+	if len(parts) != 2 {
+		return passwordRecord{Algorithm: "bcrypt", Hash: raw}
+	}
+
+	return passwordRecord{Algorithm: parts[0], Hash: []byte(parts[1])}
 }
 
-func (s *Service) setPasswordHash(ctx context.Context, userID influxdb.ID, hash []byte) error {
-	return s.kv.Update(ctx, func(tx Tx) error {
-		return s.setPasswordHashTx(ctx, tx, userID, hash)
+// algorithm returns the configured password hashing algorithm, defaulting to
+// bcrypt when the service hasn't been given one.
+func (s *Service) algorithm() string {
+	if s.Algorithm == "" {
+		return DefaultAlgorithm
+	}
+	return s.Algorithm
+}
+
+// crypterFor looks up the Crypt implementation registered for algo. It falls
+// back to s.Hash (or Bcrypt, if that is also unset) for the "bcrypt" tag so
+// that tests and callers which configure Service.Hash directly keep working.
+func (s *Service) crypterFor(algo string) (Crypt, bool) {
+	if algo == "bcrypt" && s.Hash != nil {
+		return s.Hash, true
+	}
+	c, ok := cryptRegistry[algo]
+	return c, ok
+}
+
+// scramCredential holds the SCRAM-SHA-256 material derived from a user's
+// password, per RFC 5802. It is stored gob-free as JSON since it's a small,
+// fixed-shape record and doesn't need the compactness of a binary encoding.
+type scramCredential struct {
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iterations"`
+	StoredKey  []byte `json:"storedKey"`
+	ServerKey  []byte `json:"serverKey"`
+}
+
+// scramIterations returns the configured PBKDF2 iteration count, defaulting
+// to DefaultSCRAMIterations when the service hasn't been given one.
+func (s *Service) scramIterations() int {
+	if s.SCRAMIterations <= 0 {
+		return DefaultSCRAMIterations
+	}
+	return s.SCRAMIterations
+}
+
+// scramSaltLen returns the configured salt length in bytes, defaulting to
+// DefaultSCRAMSaltLen when the service hasn't been given one.
+func (s *Service) scramSaltLen() int {
+	if s.SCRAMSaltLen <= 0 {
+		return DefaultSCRAMSaltLen
+	}
+	return s.SCRAMSaltLen
+}
+
+// generateSCRAMCredential derives the SCRAM-SHA-256 StoredKey/ServerKey pair
+// for password, per RFC 5802:
+//
+//	SaltedPassword = PBKDF2(HMAC-SHA-256, password, salt, iters, 32)
+//	ClientKey      = HMAC(SaltedPassword, "Client Key")
+//	StoredKey      = SHA-256(ClientKey)
+//	ServerKey      = HMAC(SaltedPassword, "Server Key")
+func (s *Service) generateSCRAMCredential(password string) (scramCredential, error) {
+	salt := make([]byte, s.scramSaltLen())
+	if _, err := rand.Read(salt); err != nil {
+		return scramCredential{}, InternalPasswordHashError(err)
+	}
+
+	iters := s.scramIterations()
+	saltedPassword := pbkdf2.Key([]byte(password), salt, iters, sha256.Size, sha256.New)
+
+	clientKey := hmacSHA256(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := hmacSHA256(saltedPassword, []byte("Server Key"))
+
+	return scramCredential{
+		Salt:       salt,
+		Iterations: iters,
+		StoredKey:  storedKey[:],
+		ServerKey:  serverKey,
+	}, nil
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// GetSCRAMCredentials returns the SCRAM-SHA-256 material stored for userID,
+// for use by a SASL SCRAM-SHA-256 auth mechanism.
+func (s *Service) GetSCRAMCredentials(ctx context.Context, userID influxdb.ID) (salt []byte, iters int, storedKey, serverKey []byte, err error) {
+	err = s.kv.View(ctx, func(tx Tx) error {
+		creds, err := s.getCredentialsTx(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+		if creds.Disabled {
+			// DisablePassword disables every non-token authenticator on the
+			// account, not just HTTP basic auth: SASL/SCRAM must be rejected
+			// too, or disabling a password would be bypassable over SCRAM.
+			return EIncorrectPassword
+		}
+
+		encodedID, err := userID.Encode()
+		if err != nil {
+			return CorruptUserIDError(userID.String(), err)
+		}
+
+		b, err := tx.Bucket(userpasswordscramBucket)
+		if err != nil {
+			return UnavailablePasswordServiceError(err)
+		}
+
+		raw, err := b.Get(encodedID)
+		if err != nil {
+			return EIncorrectPassword
+		}
+
+		var cred scramCredential
+		if err := json.Unmarshal(raw, &cred); err != nil {
+			return CorruptUserIDError(userID.String(), err)
+		}
+
+		salt, iters, storedKey, serverKey = cred.Salt, cred.Iterations, cred.StoredKey, cred.ServerKey
+		return nil
 	})
+
+	return salt, iters, storedKey, serverKey, err
 }
 
-func (s *Service) setPasswordHashTx(ctx context.Context, tx Tx, userID influxdb.ID, hash []byte) error {
+func (s *Service) setSCRAMCredentialTx(ctx context.Context, tx Tx, userID influxdb.ID, cred scramCredential) error {
 	encodedID, err := userID.Encode()
 	if err != nil {
 		return CorruptUserIDError(userID.String(), err)
@@ -166,64 +578,878 @@ func (s *Service) setPasswordHashTx(ctx context.Context, tx Tx, userID influxdb.
 		return EIncorrectUser
 	}
 
-	b, err := tx.Bucket(userpasswordBucket)
+	b, err := tx.Bucket(userpasswordscramBucket)
 	if err != nil {
 		return UnavailablePasswordServiceError(err)
 	}
 
-	if err := b.Put(encodedID, hash); err != nil {
+	raw, err := json.Marshal(cred)
+	if err != nil {
+		return InternalPasswordHashError(err)
+	}
+
+	if err := b.Put(encodedID, raw); err != nil {
 		return UnavailablePasswordServiceError(err)
 	}
 
 	return nil
 }
 
-func (s *Service) generatePasswordHash(password string) ([]byte, error) {
-	if len(password) < MinPasswordLength {
-		return nil, EShortPassword
+// VerifySCRAMClientProof checks a SASL SCRAM-SHA-256 client proof against
+// storedKey, per RFC 5802:
+//
+//	ClientSignature = HMAC(StoredKey, AuthMessage)
+//	ClientKey       = ClientProof XOR ClientSignature
+//	verify SHA-256(ClientKey) == StoredKey
+//
+// On success it also returns the ServerSignature the server should send
+// back to the client to complete the exchange.
+func VerifySCRAMClientProof(authMessage, clientProof, storedKey, serverKey []byte) (ok bool, serverSignature []byte) {
+	if len(clientProof) != len(storedKey) {
+		return false, nil
 	}
 
-	hasher := s.Hash
-	if hasher == nil {
-		hasher = &Bcrypt{}
+	clientSignature := hmacSHA256(storedKey, authMessage)
+
+	clientKey := make([]byte, len(clientProof))
+	for i := range clientKey {
+		clientKey[i] = clientProof[i] ^ clientSignature[i]
 	}
-	hash, err := hasher.GenerateFromPassword([]byte(password), DefaultCost)
-	if err != nil {
-		return nil, InternalPasswordHashError(err)
+
+	gotStoredKey := sha256.Sum256(clientKey)
+	if !constantTimeEqual(gotStoredKey[:], storedKey) {
+		return false, nil
 	}
-	return hash, nil
+
+	return true, hmacSHA256(serverKey, authMessage)
 }
 
-// DefaultCost is the cost that will actually be set if a cost below MinCost
-// is passed into GenerateFromPassword
-var DefaultCost = bcrypt.DefaultCost
+var _ influxdb.PasswordsService = (*Service)(nil)
 
-// Crypt represents a cryptographic hashing function.
-type Crypt interface {
-	// CompareHashAndPassword compares a hashed password with its possible plaintext equivalent.
-	// Returns nil on success, or an error on failure.
-	CompareHashAndPassword(hashedPassword, password []byte) error
-	// GenerateFromPassword returns the hash of the password at the given cost.
-	// If the cost given is less than MinCost, the cost will be set to DefaultCost, instead.
-	GenerateFromPassword(password []byte, cost int) ([]byte, error)
-}
+// CompareAndSetPassword checks the password and if they match
+// updates to the new password.
+func (s *Service) CompareAndSetPassword(ctx context.Context, userID influxdb.ID, old string, new string) error {
+	username, err := s.userName(ctx, userID)
+	if err != nil {
+		return err
+	}
 
-var _ Crypt = (*Bcrypt)(nil)
+	if err := s.validatePassword(ctx, username, new); err != nil {
+		return err
+	}
 
-// Bcrypt implements Crypt using golang.org/x/crypto/bcrypt
-type Bcrypt struct{}
+	newHash, err := s.generatePasswordHash(new)
+	if err != nil {
+		return err
+	}
 
-// CompareHashAndPassword compares a hashed password with its possible plaintext equivalent.
-// Returns nil on success, or an error on failure.
-func (b *Bcrypt) CompareHashAndPassword(hashedPassword, password []byte) error {
-	return bcrypt.CompareHashAndPassword(hashedPassword, password)
+	newSCRAM, err := s.generateSCRAMCredential(new)
+	if err != nil {
+		return err
+	}
+
+	if err := s.compareUserPassword(ctx, userID, old); err != nil {
+		return err
+	}
+
+	return s.setCredentials(ctx, userID, newHash, newSCRAM)
 }
 
-// GenerateFromPassword returns the hash of the password at the given cost.
-// If the cost given is less than MinCost, the cost will be set to DefaultCost, instead.
-func (b *Bcrypt) GenerateFromPassword(password []byte, cost int) ([]byte, error) {
-	if cost < bcrypt.MinCost {
-		cost = DefaultCost
+// SetPassword overrides the password of a known user.
+func (s *Service) SetPassword(ctx context.Context, userID influxdb.ID, password string) error {
+	username, err := s.userName(ctx, userID)
+	if err != nil {
+		return err
 	}
-	return bcrypt.GenerateFromPassword(password, cost)
+
+	if err := s.validatePassword(ctx, username, password); err != nil {
+		return err
+	}
+
+	hash, err := s.generatePasswordHash(password)
+	if err != nil {
+		return err
+	}
+
+	scram, err := s.generateSCRAMCredential(password)
+	if err != nil {
+		return err
+	}
+
+	return s.setCredentials(ctx, userID, hash, scram)
+}
+
+// userName looks up the username for userID, for use in password policy
+// checks such as PasswordPolicy.DisallowUsernameSubstring.
+func (s *Service) userName(ctx context.Context, userID influxdb.ID) (string, error) {
+	var name string
+	err := s.kv.View(ctx, func(tx Tx) error {
+		user, err := s.findUserByID(ctx, tx, userID)
+		if err != nil {
+			return EIncorrectUser
+		}
+		name = user.Name
+		return nil
+	})
+	return name, err
+}
+
+// ComparePassword checks if the password matches the password recorded.
+// Passwords that do not match return errors.
+func (s *Service) ComparePassword(ctx context.Context, userID influxdb.ID, password string) error {
+	return s.compareUserPassword(ctx, userID, password)
+}
+
+// compareUserPassword reads userID's credentials and lockout state in a
+// View, then runs the actual hash compare - bcrypt at cost 10, or
+// argon2id/scrypt at their configured work factor - outside of any
+// transaction. Bolt only allows a single writer at a time, so running a
+// ~50-100ms KDF call inside an Update would serialize every concurrent
+// login behind it, turning the lockout feature (whose whole point is DoS
+// protection) into a DoS vector of its own. Only the rare follow-up work -
+// clearing the failure counter, recording a new failure, or rehashing onto
+// a different algorithm - happens in a (short) transaction.
+func (s *Service) compareUserPassword(ctx context.Context, userID influxdb.ID, password string) error {
+	encodedID, err := userID.Encode()
+	if err != nil {
+		return CorruptUserIDError(userID.String(), err)
+	}
+
+	creds, err := s.readCredentialsForCompare(ctx, userID, encodedID)
+	if err != nil {
+		return err
+	}
+
+	if creds.Disabled || len(creds.PasswordHash) == 0 {
+		// Run a dummy compare so a disabled or passwordless account takes
+		// the same time to reject as a real wrong-password attempt,
+		// instead of leaking account state through response latency.
+		_ = bcrypt.CompareHashAndPassword(dummyBcryptHash, []byte(password))
+		return EIncorrectPassword
+	}
+
+	record := decodePasswordRecord(creds.PasswordHash)
+	crypter, ok := s.crypterFor(record.Algorithm)
+	if !ok {
+		return EIncorrectPassword
+	}
+
+	if err := crypter.CompareHashAndPassword(record.Hash, []byte(password)); err != nil {
+		if lockErr := s.recordLoginFailure(ctx, userID, encodedID); lockErr != nil {
+			return lockErr
+		}
+		return EIncorrectPassword
+	}
+
+	return s.onSuccessfulCompare(ctx, userID, encodedID, record, password)
+}
+
+// readCredentialsForCompare checks the lockout state and reads userID's
+// Credentials in a single read-only transaction, before any password
+// hashing happens.
+func (s *Service) readCredentialsForCompare(ctx context.Context, userID influxdb.ID, encodedID []byte) (Credentials, error) {
+	var creds Credentials
+	err := s.kv.View(ctx, func(tx Tx) error {
+		if _, err := s.findUserByID(ctx, tx, userID); err != nil {
+			return EIncorrectUser
+		}
+
+		// Check the lockout state before touching the (CPU-expensive) hasher
+		// at all: the lockout exists to stop an attacker from burning server
+		// CPU via repeated bcrypt/argon2id/scrypt attempts, not just to
+		// rate-limit successful guesses.
+		if err := s.checkLockoutTx(ctx, tx, encodedID); err != nil {
+			return err
+		}
+
+		b, err := tx.Bucket(userpasswordBucket)
+		if err != nil {
+			return UnavailablePasswordServiceError(err)
+		}
+
+		stored, err := b.Get(encodedID)
+		if err != nil {
+			return EIncorrectPassword
+		}
+
+		creds, err = decodeCredentials(stored)
+		return err
+	})
+	if err != nil {
+		return Credentials{}, err
+	}
+	return creds, nil
+}
+
+// recordLoginFailure commits a single login failure for userID in its own,
+// short transaction, now that the (already failed) comparison above has
+// run outside of one.
+func (s *Service) recordLoginFailure(ctx context.Context, userID influxdb.ID, encodedID []byte) error {
+	return s.kv.Update(ctx, func(tx Tx) error {
+		return s.recordLoginFailureTx(ctx, tx, userID, encodedID)
+	})
+}
+
+// onSuccessfulCompare clears userID's failure counter and, if the matched
+// record wasn't produced with the currently configured algorithm,
+// transparently rehashes it onto the configured one - both in a single
+// short transaction opened only after the expensive comparison has already
+// succeeded.
+func (s *Service) onSuccessfulCompare(ctx context.Context, userID influxdb.ID, encodedID []byte, record passwordRecord, password string) error {
+	return s.kv.Update(ctx, func(tx Tx) error {
+		if err := s.clearFailureRecordTx(ctx, tx, encodedID); err != nil {
+			return err
+		}
+
+		if record.Algorithm == s.algorithm() {
+			return nil
+		}
+
+		newHash, err := s.generatePasswordHash(password)
+		if err != nil {
+			// The password already matched; failing to upgrade the stored
+			// hash shouldn't fail the login itself.
+			return nil
+		}
+		return s.rehashPasswordTx(ctx, tx, userID, newHash)
+	})
+}
+
+// dummyBcryptHash is a fixed bcrypt hash of an arbitrary password, compared
+// against on every disabled/passwordless login attempt purely to keep CPU
+// cost constant; its plaintext is not a real credential and is never
+// checked for a match.
+var dummyBcryptHash = []byte("$2a$10$CwTycUXWue0Thq9StjUM0uQxTmrjOE7sFIuJKqcT5/uE8Lyzy6Axe")
+
+func (s *Service) setPasswordHash(ctx context.Context, userID influxdb.ID, hash []byte) error {
+	return s.kv.Update(ctx, func(tx Tx) error {
+		return s.setPasswordHashTx(ctx, tx, userID, hash)
+	})
+}
+
+// setCredentials writes the bcrypt/argon2id/scrypt password record and the
+// SCRAM-SHA-256 credential for userID in a single transaction, so HTTP basic
+// auth and SASL/SCRAM auth are always derived from the same password.
+func (s *Service) setCredentials(ctx context.Context, userID influxdb.ID, hash []byte, scram scramCredential) error {
+	return s.kv.Update(ctx, func(tx Tx) error {
+		if err := s.setPasswordHashTx(ctx, tx, userID, hash); err != nil {
+			return err
+		}
+		return s.setSCRAMCredentialTx(ctx, tx, userID, scram)
+	})
+}
+
+// setPasswordHashTx writes hash as userID's password, preserving any
+// existing cert fingerprints on the account and clearing Disabled, since
+// setting a new password is how an operator re-enables password login.
+func (s *Service) setPasswordHashTx(ctx context.Context, tx Tx, userID influxdb.ID, hash []byte) error {
+	creds, err := s.getCredentialsTx(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+
+	creds.PasswordHash = hash
+	creds.PasswordSetAt = time.Now()
+	creds.Disabled = false
+
+	return s.putCredentialsTx(ctx, tx, userID, creds)
+}
+
+// rehashPasswordTx rewrites userID's stored password hash in place, without
+// touching PasswordSetAt or Disabled: it's called from the rehash-on-login
+// path in onSuccessfulCompare, which upgrades a record's storage format
+// after a successful compare rather than changing the password itself, and
+// must not falsify PasswordSetAt or silently re-enable a disabled account.
+func (s *Service) rehashPasswordTx(ctx context.Context, tx Tx, userID influxdb.ID, hash []byte) error {
+	creds, err := s.getCredentialsTx(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+
+	creds.PasswordHash = hash
+
+	return s.putCredentialsTx(ctx, tx, userID, creds)
+}
+
+// getCredentialsTx reads and decodes the Credentials record for userID,
+// returning a zero-value record (no error) if the user has never had one
+// set.
+func (s *Service) getCredentialsTx(ctx context.Context, tx Tx, userID influxdb.ID) (Credentials, error) {
+	encodedID, err := userID.Encode()
+	if err != nil {
+		return Credentials{}, CorruptUserIDError(userID.String(), err)
+	}
+
+	if _, err := s.findUserByID(ctx, tx, userID); err != nil {
+		return Credentials{}, EIncorrectUser
+	}
+
+	b, err := tx.Bucket(userpasswordBucket)
+	if err != nil {
+		return Credentials{}, UnavailablePasswordServiceError(err)
+	}
+
+	stored, err := b.Get(encodedID)
+	if err != nil {
+		return Credentials{}, nil
+	}
+
+	return decodeCredentials(stored)
+}
+
+// putCredentialsTx gob-encodes and writes creds as userID's Credentials
+// record.
+func (s *Service) putCredentialsTx(ctx context.Context, tx Tx, userID influxdb.ID, creds Credentials) error {
+	encodedID, err := userID.Encode()
+	if err != nil {
+		return CorruptUserIDError(userID.String(), err)
+	}
+
+	if _, err := s.findUserByID(ctx, tx, userID); err != nil {
+		return EIncorrectUser
+	}
+
+	b, err := tx.Bucket(userpasswordBucket)
+	if err != nil {
+		return UnavailablePasswordServiceError(err)
+	}
+
+	raw, err := encodeCredentials(creds)
+	if err != nil {
+		return InternalPasswordHashError(err)
+	}
+
+	if err := b.Put(encodedID, raw); err != nil {
+		return UnavailablePasswordServiceError(err)
+	}
+
+	return nil
+}
+
+// AddCertFingerprint registers fp as a TLS client-certificate fingerprint
+// that authenticates userID, indexing it in usercertfpv1 for O(1) lookup by
+// AuthenticateByCert.
+func (s *Service) AddCertFingerprint(ctx context.Context, userID influxdb.ID, fp string) error {
+	return s.kv.Update(ctx, func(tx Tx) error {
+		creds, err := s.getCredentialsTx(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+
+		for _, existing := range creds.CertFingerprints {
+			if existing == fp {
+				return nil
+			}
+		}
+		creds.CertFingerprints = append(creds.CertFingerprints, fp)
+
+		if err := s.putCredentialsTx(ctx, tx, userID, creds); err != nil {
+			return err
+		}
+
+		return s.putCertFingerprintIndexTx(ctx, tx, fp, userID)
+	})
+}
+
+// RemoveCertFingerprint removes fp from the set of certificate fingerprints
+// that authenticate userID, and drops it from the usercertfpv1 index.
+func (s *Service) RemoveCertFingerprint(ctx context.Context, userID influxdb.ID, fp string) error {
+	return s.kv.Update(ctx, func(tx Tx) error {
+		creds, err := s.getCredentialsTx(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+
+		kept := creds.CertFingerprints[:0]
+		for _, existing := range creds.CertFingerprints {
+			if existing != fp {
+				kept = append(kept, existing)
+			}
+		}
+		creds.CertFingerprints = kept
+
+		if err := s.putCredentialsTx(ctx, tx, userID, creds); err != nil {
+			return err
+		}
+
+		b, err := tx.Bucket(usercertfpBucket)
+		if err != nil {
+			return UnavailablePasswordServiceError(err)
+		}
+		if err := b.Delete([]byte(fp)); err != nil {
+			return UnavailablePasswordServiceError(err)
+		}
+
+		return nil
+	})
+}
+
+// AuthenticateByCert looks up the user authenticated by the TLS client
+// certificate with fingerprint fp, for use during TLS client-cert auth.
+func (s *Service) AuthenticateByCert(ctx context.Context, fp string) (influxdb.ID, error) {
+	var userID influxdb.ID
+	err := s.kv.View(ctx, func(tx Tx) error {
+		b, err := tx.Bucket(usercertfpBucket)
+		if err != nil {
+			return UnavailablePasswordServiceError(err)
+		}
+
+		encodedID, err := b.Get([]byte(fp))
+		if err != nil {
+			return EIncorrectPassword
+		}
+
+		return userID.Decode(encodedID)
+	})
+
+	return userID, err
+}
+
+func (s *Service) putCertFingerprintIndexTx(ctx context.Context, tx Tx, fp string, userID influxdb.ID) error {
+	b, err := tx.Bucket(usercertfpBucket)
+	if err != nil {
+		return UnavailablePasswordServiceError(err)
+	}
+
+	encodedID, err := userID.Encode()
+	if err != nil {
+		return CorruptUserIDError(userID.String(), err)
+	}
+
+	if err := b.Put([]byte(fp), encodedID); err != nil {
+		return UnavailablePasswordServiceError(err)
+	}
+
+	return nil
+}
+
+// DisablePassword marks userID's password as disabled, so ComparePassword
+// and CompareAndSetPassword will reject it (constant-time, without invoking
+// the hasher) until a new password is set via SetPassword.
+func (s *Service) DisablePassword(ctx context.Context, userID influxdb.ID) error {
+	return s.kv.Update(ctx, func(tx Tx) error {
+		creds, err := s.getCredentialsTx(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+
+		creds.Disabled = true
+
+		return s.putCredentialsTx(ctx, tx, userID, creds)
+	})
+}
+
+// PasswordClass is a bitmask of character classes a password may be
+// required to contain.
+type PasswordClass uint8
+
+// String renders the classes set in p as a comma-separated list, for use in
+// error messages.
+func (p PasswordClass) String() string {
+	var classes []string
+	if p&PasswordClassUpper != 0 {
+		classes = append(classes, "an uppercase letter")
+	}
+	if p&PasswordClassLower != 0 {
+		classes = append(classes, "a lowercase letter")
+	}
+	if p&PasswordClassDigit != 0 {
+		classes = append(classes, "a digit")
+	}
+	if p&PasswordClassSymbol != 0 {
+		classes = append(classes, "a symbol")
+	}
+	return strings.Join(classes, ", ")
+}
+
+// Character classes for PasswordPolicy.RequireClasses.
+const (
+	PasswordClassUpper PasswordClass = 1 << iota
+	PasswordClassLower
+	PasswordClassDigit
+	PasswordClassSymbol
+)
+
+// BreachChecker reports whether a password is known to be compromised, e.g.
+// by appearing in a public breach corpus.
+type BreachChecker interface {
+	CheckCompromised(ctx context.Context, password string) (bool, error)
+}
+
+// NoopBreachChecker is a BreachChecker that never flags a password as
+// compromised; it's the default when Service.PasswordPolicy.BreachChecker is
+// left unset.
+type NoopBreachChecker struct{}
+
+// CheckCompromised always reports false.
+func (NoopBreachChecker) CheckCompromised(ctx context.Context, password string) (bool, error) {
+	return false, nil
+}
+
+// PasswordPolicy configures the password strength rules generatePasswordHash
+// enforces before hashing a new password.
+type PasswordPolicy struct {
+	MinLength                 int
+	MaxLength                 int
+	RequireClasses            PasswordClass
+	DisallowUsernameSubstring bool
+	BreachChecker             BreachChecker
+}
+
+// passwordPolicy returns the configured PasswordPolicy, filling in defaults
+// for any zero-valued fields.
+func (s *Service) passwordPolicy() PasswordPolicy {
+	p := s.PasswordPolicy
+	if p.MinLength == 0 {
+		p.MinLength = MinPasswordLength
+	}
+	if p.BreachChecker == nil {
+		p.BreachChecker = NoopBreachChecker{}
+	}
+	return p
+}
+
+// validatePassword runs the configured PasswordPolicy against password,
+// returning a targeted error code for the first rule it fails. It runs
+// before hashing so policy rejections don't pay for a wasted bcrypt (or
+// argon2id/scrypt) round.
+func (s *Service) validatePassword(ctx context.Context, username, password string) error {
+	policy := s.passwordPolicy()
+
+	if len(password) < policy.MinLength {
+		return EPasswordTooShort(policy.MinLength)
+	}
+	if policy.MaxLength > 0 && len(password) > policy.MaxLength {
+		return EPasswordTooLong(policy.MaxLength)
+	}
+
+	if missing := policy.RequireClasses &^ passwordClasses(password); missing != 0 {
+		return EPasswordMissingClass(missing)
+	}
+
+	if policy.DisallowUsernameSubstring && username != "" &&
+		strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return EPasswordContainsUsername
+	}
+
+	compromised, err := policy.BreachChecker.CheckCompromised(ctx, password)
+	if err != nil {
+		return InternalPasswordHashError(err)
+	}
+	if compromised {
+		return EPasswordTooCommon
+	}
+
+	return nil
+}
+
+// passwordClasses reports which PasswordClass bits are present in password.
+func passwordClasses(password string) PasswordClass {
+	var classes PasswordClass
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			classes |= PasswordClassUpper
+		case unicode.IsLower(r):
+			classes |= PasswordClassLower
+		case unicode.IsDigit(r):
+			classes |= PasswordClassDigit
+		case unicode.IsPunct(r), unicode.IsSymbol(r):
+			classes |= PasswordClassSymbol
+		}
+	}
+	return classes
+}
+
+func (s *Service) generatePasswordHash(password string) ([]byte, error) {
+	algo := s.algorithm()
+	hasher, ok := s.crypterFor(algo)
+	if !ok {
+		return nil, InternalPasswordHashError(fmt.Errorf("unknown password algorithm %q", algo))
+	}
+
+	hash, err := hasher.GenerateFromPassword([]byte(password), DefaultCost)
+	if err != nil {
+		return nil, InternalPasswordHashError(err)
+	}
+
+	// bcrypt hashes are otherwise indistinguishable from the legacy
+	// unprefixed records, so tag them with their cost explicitly; the other
+	// algorithms already self-describe their params in the blob they return.
+	if algo == "bcrypt" {
+		hash = []byte(fmt.Sprintf("cost=%d$%s", DefaultCost, hash))
+	}
+
+	return encodePasswordRecord(passwordRecord{Algorithm: algo, Hash: hash}), nil
+}
+
+// DefaultCost is the cost that will actually be set if a cost below MinCost
+// is passed into GenerateFromPassword
+var DefaultCost = bcrypt.DefaultCost
+
+// Crypt represents a cryptographic hashing function.
+type Crypt interface {
+	// CompareHashAndPassword compares a hashed password with its possible plaintext equivalent.
+	// Returns nil on success, or an error on failure.
+	CompareHashAndPassword(hashedPassword, password []byte) error
+	// GenerateFromPassword returns the hash of the password at the given cost.
+	// If the cost given is less than MinCost, the cost will be set to DefaultCost, instead.
+	GenerateFromPassword(password []byte, cost int) ([]byte, error)
+}
+
+var _ Crypt = (*Bcrypt)(nil)
+
+// Bcrypt implements Crypt using golang.org/x/crypto/bcrypt
+type Bcrypt struct{}
+
+// CompareHashAndPassword compares a hashed password with its possible plaintext equivalent.
+// Returns nil on success, or an error on failure.
+func (b *Bcrypt) CompareHashAndPassword(hashedPassword, password []byte) error {
+	// Records written since pluggable algorithms were added carry a
+	// "cost=N$" wrapper in front of the actual bcrypt hash; strip it so the
+	// stdlib bcrypt package only ever sees the hash it produced.
+	if rest, ok := cutCostPrefix(hashedPassword); ok {
+		hashedPassword = rest
+	}
+	return bcrypt.CompareHashAndPassword(hashedPassword, password)
+}
+
+// GenerateFromPassword returns the hash of the password at the given cost.
+// If the cost given is less than MinCost, the cost will be set to DefaultCost, instead.
+func (b *Bcrypt) GenerateFromPassword(password []byte, cost int) ([]byte, error) {
+	if cost < bcrypt.MinCost {
+		cost = DefaultCost
+	}
+	return bcrypt.GenerateFromPassword(password, cost)
+}
+
+// cutCostPrefix strips a leading "cost=N$" wrapper from a stored bcrypt
+// record, returning the underlying bcrypt hash and whether a wrapper was
+// present.
+func cutCostPrefix(hash []byte) ([]byte, bool) {
+	if !strings.HasPrefix(string(hash), "cost=") {
+		return hash, false
+	}
+	idx := strings.IndexByte(string(hash), '$')
+	if idx < 0 {
+		return hash, false
+	}
+	return hash[idx+1:], true
+}
+
+const (
+	argon2idMemoryKiB  = 64 * 1024
+	argon2idIterations = 3
+	argon2idThreads    = 2
+	argon2idKeyLen     = 32
+	argon2idSaltLen    = 16
+
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+	scryptKeyLen  = 32
+	scryptSaltLen = 16
+)
+
+var _ Crypt = (*Argon2id)(nil)
+
+// Argon2id implements Crypt using golang.org/x/crypto/argon2's Argon2id
+// variant, the KDF recommended by the current OWASP password storage
+// guidance.
+type Argon2id struct{}
+
+// GenerateFromPassword derives an Argon2id hash, ignoring cost (Argon2id's
+// work factor is controlled by the memory/time/thread constants above, not a
+// single cost integer) and returns a self-describing
+// "m=<kib>,t=<iters>,p=<threads>$<salt>$<hash>" blob.
+func (a *Argon2id) GenerateFromPassword(password []byte, cost int) ([]byte, error) {
+	salt := make([]byte, argon2idSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	hash := argon2.IDKey(password, salt, argon2idIterations, argon2idMemoryKiB, argon2idThreads, argon2idKeyLen)
+
+	return []byte(fmt.Sprintf("m=%d,t=%d,p=%d$%s$%s",
+		argon2idMemoryKiB, argon2idIterations, argon2idThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash),
+	)), nil
+}
+
+// CompareHashAndPassword compares an Argon2id blob produced by
+// GenerateFromPassword with its possible plaintext equivalent.
+func (a *Argon2id) CompareHashAndPassword(hashedPassword, password []byte) error {
+	params, saltB64, hashB64, err := splitArgon2idBlob(string(hashedPassword))
+	if err != nil {
+		return err
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(saltB64)
+	if err != nil {
+		return err
+	}
+	want, err := base64.RawStdEncoding.DecodeString(hashB64)
+	if err != nil {
+		return err
+	}
+
+	got := argon2.IDKey(password, salt, params.iterations, params.memoryKiB, params.threads, uint32(len(want)))
+	if !constantTimeEqual(got, want) {
+		return fmt.Errorf("argon2id: hash mismatch")
+	}
+	return nil
+}
+
+type argon2idParams struct {
+	memoryKiB  uint32
+	iterations uint32
+	threads    uint8
+}
+
+func splitArgon2idBlob(blob string) (argon2idParams, string, string, error) {
+	parts := strings.Split(blob, "$")
+	if len(parts) != 3 {
+		return argon2idParams{}, "", "", fmt.Errorf("argon2id: malformed hash")
+	}
+
+	var params argon2idParams
+	if _, err := fmt.Sscanf(parts[0], "m=%d,t=%d,p=%d", &params.memoryKiB, &params.iterations, &params.threads); err != nil {
+		return argon2idParams{}, "", "", fmt.Errorf("argon2id: malformed params: %w", err)
+	}
+
+	return params, parts[1], parts[2], nil
+}
+
+var _ Crypt = (*Scrypt)(nil)
+
+// Scrypt implements Crypt using golang.org/x/crypto/scrypt.
+type Scrypt struct{}
+
+// GenerateFromPassword derives a scrypt hash, ignoring cost in favor of the
+// N/r/p constants above, and returns a self-describing
+// "n=<N>,r=<r>,p=<p>$<salt>$<hash>" blob.
+func (sc *Scrypt) GenerateFromPassword(password []byte, cost int) ([]byte, error) {
+	salt := make([]byte, scryptSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	hash, err := scrypt.Key(password, salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(fmt.Sprintf("n=%d,r=%d,p=%d$%s$%s",
+		scryptN, scryptR, scryptP,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash),
+	)), nil
+}
+
+// CompareHashAndPassword compares a scrypt blob produced by
+// GenerateFromPassword with its possible plaintext equivalent.
+func (sc *Scrypt) CompareHashAndPassword(hashedPassword, password []byte) error {
+	parts := strings.Split(string(hashedPassword), "$")
+	if len(parts) != 3 {
+		return fmt.Errorf("scrypt: malformed hash")
+	}
+
+	var n, r, p int
+	if _, err := fmt.Sscanf(parts[0], "n=%d,r=%d,p=%d", &n, &r, &p); err != nil {
+		return fmt.Errorf("scrypt: malformed params: %w", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+
+	got, err := scrypt.Key(password, salt, n, r, p, len(want))
+	if err != nil {
+		return err
+	}
+	if !constantTimeEqual(got, want) {
+		return fmt.Errorf("scrypt: hash mismatch")
+	}
+	return nil
+}
+
+// constantTimeEqual reports whether a and b hold the same bytes, without
+// leaking timing information about where they first differ.
+func constantTimeEqual(a, b []byte) bool {
+	return len(a) == len(b) && subtle.ConstantTimeCompare(a, b) == 1
+}
+
+var _ BreachChecker = (*BloomBreachChecker)(nil)
+
+// sha1PrefixLen is the number of leading hex characters of a SHA-1 hash that
+// BloomBreachChecker partitions its corpus on, k-anonymity style: the same
+// range HIBP's API exposes so a full password hash never has to be compared
+// (or, for a remote lookup, transmitted) in one piece.
+const sha1PrefixLen = 5
+
+// BloomBreachChecker is a local, offline BreachChecker backed by an in-memory
+// index of known-compromised password SHA-1 hashes. It never makes a
+// network call: the index is built once at startup from a flat file of
+// full SHA-1 hex hashes (one per line), the same format services like HIBP
+// distribute for offline use.
+//
+// Matching follows HIBP's own range-API semantics: the corpus is keyed by
+// sha1PrefixLen-character prefix, and CheckCompromised only reports a match
+// when the remaining suffix is also present in that prefix's bucket. Prefix
+// collisions are common (2^20 possible prefixes), but they only narrow down
+// which bucket to search - they never cause a false positive, unlike
+// matching on the prefix alone.
+type BloomBreachChecker struct {
+	// corpus maps a sha1PrefixLen-character hash prefix to the set of
+	// suffixes seen in the loaded corpus for that prefix.
+	corpus map[string]map[string]struct{}
+}
+
+// NewBloomBreachChecker builds a BloomBreachChecker from r, a file of
+// newline-separated, full 40-character SHA-1 hex hashes. Lines shorter than
+// sha1PrefixLen are ignored, since they can't be indexed.
+func NewBloomBreachChecker(r io.Reader) (*BloomBreachChecker, error) {
+	corpus := make(map[string]map[string]struct{})
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.ToUpper(strings.TrimSpace(scanner.Text()))
+		if len(line) < sha1PrefixLen {
+			continue
+		}
+
+		prefix, suffix := line[:sha1PrefixLen], line[sha1PrefixLen:]
+		if corpus[prefix] == nil {
+			corpus[prefix] = make(map[string]struct{})
+		}
+		corpus[prefix][suffix] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &BloomBreachChecker{corpus: corpus}, nil
+}
+
+// CheckCompromised reports whether password's full SHA-1 hash matches an
+// entry in the loaded breach corpus.
+//
+//nolint:gosec // SHA-1 here is a corpus lookup key, not a security boundary.
+func (c *BloomBreachChecker) CheckCompromised(ctx context.Context, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:sha1PrefixLen], hash[sha1PrefixLen:]
+
+	suffixes, ok := c.corpus[prefix]
+	if !ok {
+		return false, nil
+	}
+	_, found := suffixes[suffix]
+	return found, nil
 }
@@ -0,0 +1,398 @@
+package kv
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+
+	"github.com/influxdata/influxdb/v2"
+)
+
+func TestDecodePasswordRecord_LegacyBcrypt(t *testing.T) {
+	legacy := []byte("$2a$10$abcdefghijklmnopqrstuvCwTycUXWue0Thq9StjUM0uQxTmrjO")
+
+	rec := decodePasswordRecord(legacy)
+
+	if rec.Algorithm != "bcrypt" {
+		t.Fatalf("Algorithm = %q, want %q", rec.Algorithm, "bcrypt")
+	}
+	if string(rec.Hash) != string(legacy) {
+		t.Fatalf("Hash = %q, want unmodified legacy value %q", rec.Hash, legacy)
+	}
+}
+
+func TestEncodeDecodePasswordRecord_RoundTrip(t *testing.T) {
+	want := passwordRecord{Algorithm: "argon2id", Hash: []byte("m=65536,t=3,p=2$c2FsdA$aGFzaA")}
+
+	got := decodePasswordRecord(encodePasswordRecord(want))
+
+	if got.Algorithm != want.Algorithm || string(got.Hash) != string(want.Hash) {
+		t.Fatalf("round trip = %+v, want %+v", got, want)
+	}
+}
+
+func TestGeneratePasswordHash_RoundTrip(t *testing.T) {
+	for _, algo := range []string{"bcrypt", "argon2id", "scrypt"} {
+		t.Run(algo, func(t *testing.T) {
+			s := &Service{Algorithm: algo}
+
+			stored, err := s.generatePasswordHash("correct horse battery staple")
+			if err != nil {
+				t.Fatalf("generatePasswordHash: %v", err)
+			}
+
+			rec := decodePasswordRecord(stored)
+			if rec.Algorithm != algo {
+				t.Fatalf("stored Algorithm = %q, want %q", rec.Algorithm, algo)
+			}
+
+			crypter, ok := s.crypterFor(rec.Algorithm)
+			if !ok {
+				t.Fatalf("crypterFor(%q) not found", rec.Algorithm)
+			}
+
+			if err := crypter.CompareHashAndPassword(rec.Hash, []byte("correct horse battery staple")); err != nil {
+				t.Fatalf("CompareHashAndPassword(correct password): %v", err)
+			}
+			if err := crypter.CompareHashAndPassword(rec.Hash, []byte("wrong password")); err == nil {
+				t.Fatal("CompareHashAndPassword(wrong password) = nil, want error")
+			}
+		})
+	}
+}
+
+func TestServiceAlgorithm_DefaultsToBcrypt(t *testing.T) {
+	s := &Service{}
+	if got := s.algorithm(); got != DefaultAlgorithm {
+		t.Fatalf("algorithm() = %q, want %q", got, DefaultAlgorithm)
+	}
+}
+
+func TestGenerateSCRAMCredential_VerifyClientProof(t *testing.T) {
+	s := &Service{SCRAMIterations: 4096, SCRAMSaltLen: 16}
+
+	cred, err := s.generateSCRAMCredential("correct horse battery staple")
+	if err != nil {
+		t.Fatalf("generateSCRAMCredential: %v", err)
+	}
+
+	// Re-derive what a SASL client would compute from the same
+	// salt/iterations to produce its ClientProof, per RFC 5802.
+	authMessage := []byte("n=user,r=clientnonce,r=clientnonce,s=salt,i=4096,c=biws,r=clientnonce")
+	saltedPassword := pbkdf2.Key([]byte("correct horse battery staple"), cred.Salt, cred.Iterations, sha256.Size, sha256.New)
+	clientKey := hmacSHA256(saltedPassword, []byte("Client Key"))
+	clientSignature := hmacSHA256(cred.StoredKey, authMessage)
+
+	clientProof := make([]byte, len(clientKey))
+	for i := range clientProof {
+		clientProof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	ok, serverSignature := VerifySCRAMClientProof(authMessage, clientProof, cred.StoredKey, cred.ServerKey)
+	if !ok {
+		t.Fatal("VerifySCRAMClientProof() = false, want true")
+	}
+
+	want := hmacSHA256(cred.ServerKey, authMessage)
+	if string(serverSignature) != string(want) {
+		t.Fatalf("serverSignature = %x, want %x", serverSignature, want)
+	}
+
+	// A proof derived from the wrong password must not verify.
+	wrongSaltedPassword := pbkdf2.Key([]byte("wrong password"), cred.Salt, cred.Iterations, sha256.Size, sha256.New)
+	wrongClientKey := hmacSHA256(wrongSaltedPassword, []byte("Client Key"))
+	wrongProof := make([]byte, len(wrongClientKey))
+	for i := range wrongProof {
+		wrongProof[i] = wrongClientKey[i] ^ clientSignature[i]
+	}
+	if ok, _ := VerifySCRAMClientProof(authMessage, wrongProof, cred.StoredKey, cred.ServerKey); ok {
+		t.Fatal("VerifySCRAMClientProof() with wrong-password proof = true, want false")
+	}
+}
+
+func TestServiceSCRAMDefaults(t *testing.T) {
+	s := &Service{}
+	if got := s.scramIterations(); got != DefaultSCRAMIterations {
+		t.Fatalf("scramIterations() = %d, want %d", got, DefaultSCRAMIterations)
+	}
+	if got := s.scramSaltLen(); got != DefaultSCRAMSaltLen {
+		t.Fatalf("scramSaltLen() = %d, want %d", got, DefaultSCRAMSaltLen)
+	}
+}
+
+func TestDecodeCredentials_LegacyBarePasswordHash(t *testing.T) {
+	legacy := []byte("$2a$10$abcdefghijklmnopqrstuvCwTycUXWue0Thq9StjUM0uQxTmrjO")
+
+	creds, err := decodeCredentials(legacy)
+	if err != nil {
+		t.Fatalf("decodeCredentials: %v", err)
+	}
+
+	if string(creds.PasswordHash) != string(legacy) {
+		t.Fatalf("PasswordHash = %q, want legacy value %q", creds.PasswordHash, legacy)
+	}
+	if creds.Disabled {
+		t.Fatal("Disabled = true for a legacy record, want false")
+	}
+	if len(creds.CertFingerprints) != 0 {
+		t.Fatalf("CertFingerprints = %v, want none for a legacy record", creds.CertFingerprints)
+	}
+}
+
+func TestEncodeDecodeCredentials_RoundTrip(t *testing.T) {
+	want := Credentials{
+		PasswordHash:     []byte("bcrypt$cost=10$somehash"),
+		CertFingerprints: []string{"aa:bb:cc", "dd:ee:ff"},
+		Disabled:         true,
+		PasswordSetAt:    time.Unix(1700000000, 0).UTC(),
+	}
+
+	raw, err := encodeCredentials(want)
+	if err != nil {
+		t.Fatalf("encodeCredentials: %v", err)
+	}
+
+	got, err := decodeCredentials(raw)
+	if err != nil {
+		t.Fatalf("decodeCredentials: %v", err)
+	}
+
+	if string(got.PasswordHash) != string(want.PasswordHash) ||
+		!reflect.DeepEqual(got.CertFingerprints, want.CertFingerprints) ||
+		got.Disabled != want.Disabled ||
+		!got.PasswordSetAt.Equal(want.PasswordSetAt) {
+		t.Fatalf("round trip = %+v, want %+v", got, want)
+	}
+}
+
+func TestNextLockoutDuration_SaturatesInsteadOfOverflowing(t *testing.T) {
+	const threshold = 5
+
+	cases := []struct {
+		name      string
+		failCount uint32
+		want      time.Duration
+	}{
+		{"at threshold", 5, time.Minute},
+		{"one past threshold", 6, 2 * time.Minute},
+		{"two past threshold", 7, 4 * time.Minute},
+		{"far past threshold", 100, maxLockoutDuration},
+		{"shift exponent would overflow uint64", 1000, maxLockoutDuration},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := nextLockoutDuration(time.Minute, tc.failCount, threshold)
+			if got != tc.want {
+				t.Fatalf("nextLockoutDuration(1m, %d, %d) = %s, want %s", tc.failCount, threshold, got, tc.want)
+			}
+			if got <= 0 {
+				t.Fatalf("nextLockoutDuration(1m, %d, %d) = %s, want a positive duration", tc.failCount, threshold, got)
+			}
+		})
+	}
+}
+
+func TestServiceLockoutDefaults(t *testing.T) {
+	s := &Service{}
+	if got := s.lockoutThreshold(); got != DefaultLockoutThreshold {
+		t.Fatalf("lockoutThreshold() = %d, want %d", got, DefaultLockoutThreshold)
+	}
+	if got := s.lockoutWindow(); got != DefaultLockoutWindow {
+		t.Fatalf("lockoutWindow() = %s, want %s", got, DefaultLockoutWindow)
+	}
+	if got := s.lockoutBaseDuration(); got != DefaultLockoutBaseDuration {
+		t.Fatalf("lockoutBaseDuration() = %s, want %s", got, DefaultLockoutBaseDuration)
+	}
+
+	configured := &Service{LockoutThreshold: 3, LockoutWindow: time.Hour, LockoutBaseDuration: 30 * time.Second}
+	if got := configured.lockoutThreshold(); got != 3 {
+		t.Fatalf("lockoutThreshold() = %d, want 3", got)
+	}
+	if got := configured.lockoutWindow(); got != time.Hour {
+		t.Fatalf("lockoutWindow() = %s, want 1h", got)
+	}
+	if got := configured.lockoutBaseDuration(); got != 30*time.Second {
+		t.Fatalf("lockoutBaseDuration() = %s, want 30s", got)
+	}
+}
+
+func TestBloomBreachChecker_MatchesOnSHA1Prefix(t *testing.T) {
+	const compromised = "password123"
+
+	sum := sha1.Sum([]byte(compromised))
+	fullHash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	checker, err := NewBloomBreachChecker(strings.NewReader(fullHash + "\n"))
+	if err != nil {
+		t.Fatalf("NewBloomBreachChecker: %v", err)
+	}
+
+	got, err := checker.CheckCompromised(context.Background(), compromised)
+	if err != nil {
+		t.Fatalf("CheckCompromised: %v", err)
+	}
+	if !got {
+		t.Fatal("CheckCompromised(compromised) = false, want true")
+	}
+
+	// A password that merely shares the same 5-char SHA-1 prefix must NOT
+	// be flagged: CheckCompromised follows HIBP's own range-API semantics
+	// and compares the full suffix within the matching prefix bucket, so a
+	// prefix collision alone should never produce a false positive.
+	prefix := fullHash[:sha1PrefixLen]
+	for i := 0; ; i++ {
+		candidate := compromised + string(rune('a'+i))
+		sum := sha1.Sum([]byte(candidate))
+		if strings.ToUpper(hex.EncodeToString(sum[:]))[:sha1PrefixLen] == prefix {
+			got, err := checker.CheckCompromised(context.Background(), candidate)
+			if err != nil {
+				t.Fatalf("CheckCompromised: %v", err)
+			}
+			if got {
+				t.Fatal("CheckCompromised(shared-prefix password) = true, want false")
+			}
+			break
+		}
+		if i > 1<<20 {
+			t.Skip("couldn't find a colliding prefix in a reasonable number of tries")
+		}
+	}
+}
+
+func TestBloomBreachChecker_NotCompromised(t *testing.T) {
+	const compromised = "password123"
+
+	sum := sha1.Sum([]byte(compromised))
+	fullHash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	checker, err := NewBloomBreachChecker(strings.NewReader(fullHash + "\n"))
+	if err != nil {
+		t.Fatalf("NewBloomBreachChecker: %v", err)
+	}
+
+	got, err := checker.CheckCompromised(context.Background(), "a completely different password")
+	if err != nil {
+		t.Fatalf("CheckCompromised: %v", err)
+	}
+	if got {
+		t.Fatal("CheckCompromised(not compromised) = true, want false")
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   PasswordPolicy
+		username string
+		password string
+		wantErr  *influxdb.Error
+	}{
+		{
+			name:     "too short",
+			policy:   PasswordPolicy{MinLength: 10},
+			password: "short1!",
+			wantErr:  EPasswordTooShort(10),
+		},
+		{
+			name:     "too long",
+			policy:   PasswordPolicy{MaxLength: 5},
+			password: "toolongpassword",
+			wantErr:  EPasswordTooLong(5),
+		},
+		{
+			name:     "missing required class",
+			policy:   PasswordPolicy{RequireClasses: PasswordClassDigit | PasswordClassSymbol},
+			password: "alllowercase",
+			wantErr:  EPasswordMissingClass(PasswordClassDigit | PasswordClassSymbol),
+		},
+		{
+			name:     "contains username",
+			policy:   PasswordPolicy{DisallowUsernameSubstring: true},
+			username: "alice",
+			password: "aliceInWonderland1",
+			wantErr:  EPasswordContainsUsername,
+		},
+		{
+			name:     "compromised",
+			policy:   PasswordPolicy{BreachChecker: alwaysCompromised{}},
+			password: "whatever-password",
+			wantErr:  EPasswordTooCommon,
+		},
+		{
+			name:     "passes",
+			policy: PasswordPolicy{
+				MinLength:      8,
+				RequireClasses: PasswordClassUpper | PasswordClassDigit,
+			},
+			username: "alice",
+			password: "Sup3rSecret",
+			wantErr:  nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{PasswordPolicy: tt.policy}
+
+			err := s.validatePassword(context.Background(), tt.username, tt.password)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("validatePassword() = %v, want nil", err)
+				}
+				return
+			}
+
+			influxErr, ok := err.(*influxdb.Error)
+			if !ok {
+				t.Fatalf("validatePassword() = %v (%T), want *influxdb.Error", err, err)
+			}
+			if influxErr.Code != tt.wantErr.Code || influxErr.Msg != tt.wantErr.Msg {
+				t.Fatalf("validatePassword() = %+v, want %+v", influxErr, tt.wantErr)
+			}
+		})
+	}
+}
+
+type alwaysCompromised struct{}
+
+func (alwaysCompromised) CheckCompromised(ctx context.Context, password string) (bool, error) {
+	return true, nil
+}
+
+func TestValidatePassword_BreachCheckerError(t *testing.T) {
+	s := &Service{PasswordPolicy: PasswordPolicy{BreachChecker: erroringChecker{}}}
+
+	err := s.validatePassword(context.Background(), "", "some-password")
+	if err == nil {
+		t.Fatal("validatePassword() = nil, want an error")
+	}
+}
+
+type erroringChecker struct{}
+
+func (erroringChecker) CheckCompromised(ctx context.Context, password string) (bool, error) {
+	return false, errors.New("breach service unavailable")
+}
+
+func TestCrypterFor_UsesConfiguredHashForBcryptTag(t *testing.T) {
+	custom := &Bcrypt{}
+	s := &Service{Hash: custom}
+
+	got, ok := s.crypterFor("bcrypt")
+	if !ok || got != custom {
+		t.Fatalf("crypterFor(bcrypt) = (%v, %v), want (%v, true)", got, ok, custom)
+	}
+
+	if _, ok := s.crypterFor("not-a-real-algorithm"); ok {
+		t.Fatal("crypterFor(unknown) = true, want false")
+	}
+}
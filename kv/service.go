@@ -0,0 +1,57 @@
+package kv
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Service implements influxdb.PasswordsService, and the related
+// certificate/SCRAM/lockout authenticators layered on top of it, using a
+// kv.Store for persistence.
+type Service struct {
+	kv  Store
+	log *zap.Logger
+
+	// Hash overrides the Crypt used for the "bcrypt" algorithm tag. It exists
+	// so callers and tests that configure a hasher directly keep working now
+	// that Crypt implementations are otherwise looked up from cryptRegistry.
+	Hash Crypt
+
+	// Algorithm is the password hashing algorithm applied to new passwords,
+	// and the one onSuccessfulCompare transparently rehashes into on a
+	// successful login against a record stored with a different algorithm.
+	// Defaults to DefaultAlgorithm ("bcrypt") when unset.
+	Algorithm string
+
+	// SCRAMIterations is the PBKDF2 iteration count used when deriving
+	// SCRAM-SHA-256 credentials. Defaults to DefaultSCRAMIterations when
+	// left at zero.
+	SCRAMIterations int
+
+	// SCRAMSaltLen is the length, in bytes, of the random salt generated for
+	// each SCRAM-SHA-256 credential. Defaults to DefaultSCRAMSaltLen when
+	// left at zero.
+	SCRAMSaltLen int
+
+	// LockoutThreshold is the number of consecutive failed login attempts,
+	// within LockoutWindow, after which an account is locked. Defaults to
+	// DefaultLockoutThreshold when left at zero.
+	LockoutThreshold uint32
+
+	// LockoutWindow is the sliding window over which failures accumulate; a
+	// failure older than this resets the counter instead of compounding it.
+	// Defaults to DefaultLockoutWindow when left at zero.
+	LockoutWindow time.Duration
+
+	// LockoutBaseDuration is the lock duration applied on the failure that
+	// first crosses LockoutThreshold; it doubles for every failure past
+	// that, up to maxLockoutDuration. Defaults to DefaultLockoutBaseDuration
+	// when left at zero.
+	LockoutBaseDuration time.Duration
+
+	// PasswordPolicy configures the strength rules generatePasswordHash
+	// enforces before hashing a new password. The zero value is usable: it
+	// falls back to MinPasswordLength and a NoopBreachChecker.
+	PasswordPolicy PasswordPolicy
+}